@@ -17,6 +17,8 @@
 package watches
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,9 +28,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	yaml "gopkg.in/yaml.v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -36,18 +42,33 @@ var log = logf.Log.WithName("watches")
 
 // Watch - holds data used to create a mapping of GVK to ansible playbook or role.
 // The mapping is used to compose an ansible operator.
+//
+// Watch only parses and validates watches.yaml; it does not run anything
+// itself. Selector, EventFilters, Hooks, RetryBackoff, and VarsFrom are
+// inputs consumed by the controller/runner setup that constructs
+// reconcilers from a loaded Watch (predicate/list-option wiring for
+// Selector and EventFilters, hook and backoff invocation around the
+// ansible-runner run, and ResolveVarsFrom/RenderVars for VarsFrom and
+// ${CR_*} templating) - a Watch on its own is just the validated
+// configuration for that wiring, not the wiring itself.
 type Watch struct {
 	GroupVersionKind            schema.GroupVersionKind   `yaml:",inline"`
 	Blacklist                   []schema.GroupVersionKind `yaml:"blacklist"`
 	Playbook                    string                    `yaml:"playbook"`
 	Role                        string                    `yaml:"role"`
 	Vars                        map[string]interface{}    `yaml:"vars"`
+	VarsFrom                    []VarSource               `yaml:"varsFrom"`
 	MaxRunnerArtifacts          int                       `yaml:"maxRunnerArtifacts"`
 	ReconcilePeriod             time.Duration             `yaml:"reconcilePeriod"`
 	Finalizer                   *Finalizer                `yaml:"finalizer"`
 	ManageStatus                bool                      `yaml:"manageStatus"`
 	WatchDependentResources     bool                      `yaml:"watchDependentResources"`
 	WatchClusterScopedResources bool                      `yaml:"watchClusterScopedResources"`
+	Selector                    metav1.LabelSelector      `yaml:"selector"`
+	EventFilters                EventFilters              `yaml:"eventFilters"`
+	Snakecase                   bool                      `yaml:"snakecase"`
+	Hooks                       map[string]Hook           `yaml:"hooks"`
+	RetryBackoff                RetryBackoff              `yaml:"retryBackoff"`
 
 	// Not configurable via watches.yaml
 	MaxWorkers       int `yaml:"maxWorkers"`
@@ -60,6 +81,104 @@ type Finalizer struct {
 	Playbook string                 `yaml:"playbook"`
 	Role     string                 `yaml:"role"`
 	Vars     map[string]interface{} `yaml:"vars"`
+	VarsFrom []VarSource            `yaml:"varsFrom"`
+}
+
+// VarSource references vars pulled from outside of watches.yaml, similar to
+// how Helm charts pull values externally. Exactly one of SecretRef,
+// ConfigMapRef, or File must be set. At Load time only the reference itself
+// is validated; at reconcile time ResolveVarsFrom reads the referenced
+// Secret/ConfigMap/file (expected to contain a YAML mapping) and merges it
+// into the extra vars passed to ansible-runner, with later VarSource
+// entries overriding earlier ones.
+type VarSource struct {
+	SecretRef    *SecretVarSource    `yaml:"secretRef,omitempty"`
+	ConfigMapRef *ConfigMapVarSource `yaml:"configMapRef,omitempty"`
+	File         string              `yaml:"file,omitempty"`
+}
+
+// SecretVarSource references a key in a Secret whose value is a YAML
+// mapping to merge into vars. Namespace defaults to the CR's namespace when
+// empty.
+type SecretVarSource struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	Key       string `yaml:"key"`
+}
+
+// ConfigMapVarSource references a key in a ConfigMap whose value is a YAML
+// mapping to merge into vars. Namespace defaults to the CR's namespace when
+// empty.
+type ConfigMapVarSource struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	Key       string `yaml:"key"`
+}
+
+// Validate ensures that v references exactly one source, and that
+// SecretRef/ConfigMapRef specify both a name and a key.
+func (v VarSource) Validate() error {
+	set := 0
+	for _, isSet := range []bool{v.SecretRef != nil, v.ConfigMapRef != nil, v.File != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("varsFrom entry must specify exactly one of secretRef, configMapRef, or file")
+	}
+	if v.SecretRef != nil && (v.SecretRef.Name == "" || v.SecretRef.Key == "") {
+		return fmt.Errorf("varsFrom secretRef must specify name and key")
+	}
+	if v.ConfigMapRef != nil && (v.ConfigMapRef.Name == "" || v.ConfigMapRef.Key == "") {
+		return fmt.Errorf("varsFrom configMapRef must specify name and key")
+	}
+	return nil
+}
+
+// EventFilters controls which watch.Event types trigger a reconcile. Each
+// field defaults to true, so a reconcile is scheduled for every event type
+// unless explicitly disabled.
+type EventFilters struct {
+	Create  bool `yaml:"create"`
+	Update  bool `yaml:"update"`
+	Delete  bool `yaml:"delete"`
+	Generic bool `yaml:"generic"`
+}
+
+// Hook - a playbook or role invoked around the main ansible run, e.g. for
+// the "preReconcile", "postReconcile", and "preDelete" entries of
+// Watch.Hooks.
+type Hook struct {
+	Playbook string `yaml:"playbook"`
+	Role     string `yaml:"role"`
+}
+
+// preReconcile, postReconcile, and preDelete are the only hook names
+// recognized in Watch.Hooks.
+const (
+	HookPreReconcile  = "preReconcile"
+	HookPostReconcile = "postReconcile"
+	HookPreDelete     = "preDelete"
+)
+
+// validHookNames is the set of keys allowed in Watch.Hooks.
+var validHookNames = map[string]bool{
+	HookPreReconcile:  true,
+	HookPostReconcile: true,
+	HookPreDelete:     true,
+}
+
+// RetryBackoff configures the exponential backoff applied between retries
+// of a failed run, instead of re-running again at the fixed
+// ReconcilePeriod.
+type RetryBackoff struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration `yaml:"initial"`
+	// Max is the upper bound on the delay between retries.
+	Max time.Duration `yaml:"max"`
+	// Factor is multiplied into the delay after each failed retry.
+	Factor float64 `yaml:"factor"`
 }
 
 // Default values for optional fields on Watch
@@ -70,10 +189,18 @@ var (
 	manageStatusDefault                = true
 	watchDependentResourcesDefault     = true
 	watchClusterScopedResourcesDefault = false
+	eventFiltersDefault                = EventFilters{Create: true, Update: true, Delete: true, Generic: true}
+	snakecaseDefault                   = false
+	retryBackoffInitialDefault         = "1s"
+	retryBackoffMaxDefault             = "300s"
+	retryBackoffFactorDefault          = 2.0
+)
 
-	// these are overridden by cmdline flags
-	maxWorkersDefault       = 1
-	ansibleVerbosityDefault = 2
+// Fallback values for MaxWorkers/AnsibleVerbosity used by New and by
+// LoadWithOptions when Options leaves them unset.
+const (
+	defaultMaxWorkers       = 1
+	defaultAnsibleVerbosity = 2
 )
 
 // UnmarshalYAML - implements the yaml.Unmarshaler interface for Watch.
@@ -89,6 +216,7 @@ func (w *Watch) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		Playbook                    string                    `yaml:"playbook"`
 		Role                        string                    `yaml:"role"`
 		Vars                        map[string]interface{}    `yaml:"vars"`
+		VarsFrom                    []VarSource               `yaml:"varsFrom"`
 		MaxRunnerArtifacts          int                       `yaml:"maxRunnerArtifacts"`
 		ReconcilePeriod             string                    `yaml:"reconcilePeriod"`
 		ManageStatus                bool                      `yaml:"manageStatus"`
@@ -96,6 +224,15 @@ func (w *Watch) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		WatchClusterScopedResources bool                      `yaml:"watchClusterScopedResources"`
 		Blacklist                   []schema.GroupVersionKind `yaml:"blacklist"`
 		Finalizer                   *Finalizer                `yaml:"finalizer"`
+		Selector                    interface{}               `yaml:"selector"`
+		EventFilters                EventFilters              `yaml:"eventFilters"`
+		Snakecase                   bool                      `yaml:"snakecase"`
+		Hooks                       map[string]Hook           `yaml:"hooks"`
+		RetryBackoff                struct {
+			Initial string  `yaml:"initial"`
+			Max     string  `yaml:"max"`
+			Factor  float64 `yaml:"factor"`
+		} `yaml:"retryBackoff"`
 	}
 	var tmp alias
 
@@ -107,6 +244,11 @@ func (w *Watch) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	tmp.ReconcilePeriod = reconcilePeriodDefault
 	tmp.WatchClusterScopedResources = watchClusterScopedResourcesDefault
 	tmp.Blacklist = blacklistDefault
+	tmp.EventFilters = eventFiltersDefault
+	tmp.Snakecase = snakecaseDefault
+	tmp.RetryBackoff.Initial = retryBackoffInitialDefault
+	tmp.RetryBackoff.Max = retryBackoffMaxDefault
+	tmp.RetryBackoff.Factor = retryBackoffFactorDefault
 
 	if err := unmarshal(&tmp); err != nil {
 		return err
@@ -117,6 +259,21 @@ func (w *Watch) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return fmt.Errorf("failed to parse '%s' to time.Duration: %w", tmp.ReconcilePeriod, err)
 	}
 
+	retryBackoffInitial, err := time.ParseDuration(tmp.RetryBackoff.Initial)
+	if err != nil {
+		return fmt.Errorf("failed to parse retryBackoff.initial '%s' to time.Duration: %w", tmp.RetryBackoff.Initial, err)
+	}
+	retryBackoffMax, err := time.ParseDuration(tmp.RetryBackoff.Max)
+	if err != nil {
+		return fmt.Errorf("failed to parse retryBackoff.max '%s' to time.Duration: %w", tmp.RetryBackoff.Max, err)
+	}
+
+	for name := range tmp.Hooks {
+		if !validHookNames[name] {
+			return fmt.Errorf("invalid hook %q: must be one of preReconcile, postReconcile, preDelete", name)
+		}
+	}
+
 	gvk := schema.GroupVersionKind{
 		Group:   tmp.Group,
 		Version: tmp.Version,
@@ -127,33 +284,121 @@ func (w *Watch) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return fmt.Errorf("invalid GVK: %s: %w", gvk, err)
 	}
 
+	selector, err := decodeSelector(tmp.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector for GVK: %s: %w", gvk, err)
+	}
+
 	// Rewrite values to struct being unmarshalled
 	w.GroupVersionKind = gvk
 	w.Playbook = tmp.Playbook
 	w.Role = tmp.Role
 	w.Vars = tmp.Vars
+	w.VarsFrom = tmp.VarsFrom
 	w.MaxRunnerArtifacts = tmp.MaxRunnerArtifacts
-	w.MaxWorkers = getMaxWorkers(gvk, maxWorkersDefault)
+	// MaxWorkers and AnsibleVerbosity are (re-)computed from Options by
+	// LoadWithOptions; these are just sensible standalone defaults for
+	// Watches that are unmarshalled outside of that path.
+	w.MaxWorkers = defaultMaxWorkers
 	w.ReconcilePeriod = reconcilePeriod
 	w.ManageStatus = tmp.ManageStatus
 	w.WatchDependentResources = tmp.WatchDependentResources
 	w.WatchClusterScopedResources = tmp.WatchClusterScopedResources
 	w.Finalizer = tmp.Finalizer
-	w.AnsibleVerbosity = getAnsibleVerbosity(gvk, ansibleVerbosityDefault)
+	w.AnsibleVerbosity = defaultAnsibleVerbosity
 	w.Blacklist = tmp.Blacklist
+	w.Selector = selector
+	w.EventFilters = tmp.EventFilters
+	w.Snakecase = tmp.Snakecase
+	w.Hooks = tmp.Hooks
+	w.RetryBackoff = RetryBackoff{
+		Initial: retryBackoffInitial,
+		Max:     retryBackoffMax,
+		Factor:  tmp.RetryBackoff.Factor,
+	}
 	return nil
 }
 
+// decodeSelector converts the raw value yaml.v2 produced for the `selector`
+// key (typically a map[interface{}]interface{}, or nil when omitted) into a
+// metav1.LabelSelector. It does so by normalizing the map keys to strings
+// and round-tripping through encoding/json, since metav1.LabelSelector only
+// defines json tags.
+func decodeSelector(raw interface{}) (metav1.LabelSelector, error) {
+	var selector metav1.LabelSelector
+	if raw == nil {
+		return selector, nil
+	}
+	b, err := json.Marshal(stringifyYAMLKeys(raw))
+	if err != nil {
+		return selector, fmt.Errorf("failed to marshal selector: %w", err)
+	}
+	if err := json.Unmarshal(b, &selector); err != nil {
+		return selector, fmt.Errorf("failed to unmarshal selector: %w", err)
+	}
+	return selector, nil
+}
+
+// stringifyYAMLKeys recursively converts the map[interface{}]interface{}
+// values produced by gopkg.in/yaml.v2 into map[string]interface{}, which is
+// what encoding/json requires.
+func stringifyYAMLKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = stringifyYAMLKeys(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = stringifyYAMLKeys(val)
+		}
+		return m
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = stringifyYAMLKeys(item)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
 // Validate - ensures that a Watch is valid
 // A Watch is considered valid if it:
 // - Specifies a valid path to a Role||Playbook
 // - If a Finalizer is non-nil, it must have a name + valid path to a Role||Playbook or Vars
-func (w *Watch) Validate() error {
-	err := verifyAnsiblePath(w.Playbook, w.Role)
+// - Its Selector, if set, parses into a valid label selector
+// - Every hook in Hooks has a valid path to a Role||Playbook
+// - Every entry in VarsFrom (including the Finalizer's) references exactly one of secretRef, configMapRef, or file, with name+key set for the former two
+//
+// Role references that are not already absolute paths are resolved using
+// rolesPath (see resolveRolePath), and the resolved absolute path is stored
+// back onto w.Role/w.Finalizer.Role so downstream runner code only ever
+// sees absolute paths.
+//
+// env is used to look up ANSIBLE_ROLES_PATH when rolesPath is empty, and
+// ANSIBLE_COLLECTIONS_PATH whenever a role is resolved as a fully qualified
+// collection name; callers that don't need independent env injection can
+// pass os.LookupEnv.
+func (w *Watch) Validate(rolesPath string, env func(string) (string, bool)) error {
+	resolvedRole, err := verifyAnsiblePath(w.Playbook, w.Role, rolesPath, env)
 	if err != nil {
 		log.Error(err, fmt.Sprintf("Invalid ansible path for GVK: %v", w.GroupVersionKind.String()))
 		return err
 	}
+	if resolvedRole != "" {
+		w.Role = resolvedRole
+	}
+
+	if _, err := metav1.LabelSelectorAsSelector(&w.Selector); err != nil {
+		err = fmt.Errorf("invalid selector: %w", err)
+		log.Error(err, fmt.Sprintf("Invalid selector for GVK: %v", w.GroupVersionKind.String()))
+		return err
+	}
 
 	if w.Finalizer != nil {
 		if w.Finalizer.Name == "" {
@@ -162,12 +407,43 @@ func (w *Watch) Validate() error {
 			return err
 		}
 		// only fail if Vars not set
-		err = verifyAnsiblePath(w.Finalizer.Playbook, w.Finalizer.Role)
-		if err != nil && len(w.Finalizer.Vars) == 0 {
-			log.Error(err, fmt.Sprintf("Invalid ansible path on Finalizer for GVK: %v",
+		resolvedFinalizerRole, ferr := verifyAnsiblePath(w.Finalizer.Playbook, w.Finalizer.Role, rolesPath, env)
+		if ferr != nil && len(w.Finalizer.Vars) == 0 {
+			log.Error(ferr, fmt.Sprintf("Invalid ansible path on Finalizer for GVK: %v",
 				w.GroupVersionKind.String()))
+			return ferr
+		}
+		if resolvedFinalizerRole != "" {
+			w.Finalizer.Role = resolvedFinalizerRole
+		}
+		for i, vf := range w.Finalizer.VarsFrom {
+			if err := vf.Validate(); err != nil {
+				err = fmt.Errorf("invalid finalizer varsFrom[%d]: %w", i, err)
+				log.Error(err, fmt.Sprintf("Invalid finalizer for GVK: %v", w.GroupVersionKind.String()))
+				return err
+			}
+		}
+	}
+
+	for i, vf := range w.VarsFrom {
+		if err := vf.Validate(); err != nil {
+			err = fmt.Errorf("invalid varsFrom[%d]: %w", i, err)
+			log.Error(err, fmt.Sprintf("Invalid varsFrom for GVK: %v", w.GroupVersionKind.String()))
+			return err
+		}
+	}
+
+	for name, hook := range w.Hooks {
+		resolvedHookRole, err := verifyAnsiblePath(hook.Playbook, hook.Role, rolesPath, env)
+		if err != nil {
+			err = fmt.Errorf("invalid ansible path on %s hook: %w", name, err)
+			log.Error(err, fmt.Sprintf("Invalid hook for GVK: %v", w.GroupVersionKind.String()))
 			return err
 		}
+		if resolvedHookRole != "" {
+			hook.Role = resolvedHookRole
+			w.Hooks[name] = hook
+		}
 	}
 
 	return nil
@@ -175,7 +451,17 @@ func (w *Watch) Validate() error {
 
 // New - returns a Watch with sensible defaults.
 func New(gvk schema.GroupVersionKind, role, playbook string, vars map[string]interface{}, finalizer *Finalizer) *Watch {
+	return NewWithSelector(gvk, role, playbook, vars, finalizer, metav1.LabelSelector{})
+}
+
+// NewWithSelector - like New, but also sets Selector on the returned Watch.
+// Kept as a separate function (rather than changing New's signature) so
+// existing callers of New are not broken.
+func NewWithSelector(gvk schema.GroupVersionKind, role, playbook string, vars map[string]interface{},
+	finalizer *Finalizer, selector metav1.LabelSelector) *Watch {
 	reconcilePeriod, _ := time.ParseDuration(reconcilePeriodDefault)
+	retryBackoffInitial, _ := time.ParseDuration(retryBackoffInitialDefault)
+	retryBackoffMax, _ := time.ParseDuration(retryBackoffMaxDefault)
 	return &Watch{
 		Blacklist:                   blacklistDefault,
 		GroupVersionKind:            gvk,
@@ -183,44 +469,113 @@ func New(gvk schema.GroupVersionKind, role, playbook string, vars map[string]int
 		Role:                        role,
 		Vars:                        vars,
 		MaxRunnerArtifacts:          maxRunnerArtifactsDefault,
-		MaxWorkers:                  maxWorkersDefault,
+		MaxWorkers:                  defaultMaxWorkers,
 		ReconcilePeriod:             reconcilePeriod,
 		ManageStatus:                manageStatusDefault,
 		WatchDependentResources:     watchDependentResourcesDefault,
 		WatchClusterScopedResources: watchClusterScopedResourcesDefault,
 		Finalizer:                   finalizer,
-		AnsibleVerbosity:            ansibleVerbosityDefault,
+		AnsibleVerbosity:            defaultAnsibleVerbosity,
+		Selector:                    selector,
+		EventFilters:                eventFiltersDefault,
+		Snakecase:                   snakecaseDefault,
+		RetryBackoff: RetryBackoff{
+			Initial: retryBackoffInitial,
+			Max:     retryBackoffMax,
+			Factor:  retryBackoffFactorDefault,
+		},
 	}
 }
 
-// Load - loads a slice of Watches from the watches file from the CLI
-func Load(path string, maxWorkers, ansibleVerbosity int) ([]Watch, error) {
-	maxWorkersDefault = maxWorkers
-	ansibleVerbosityDefault = ansibleVerbosity
+// Options configures LoadWithOptions. It replaces the package-level
+// maxWorkersDefault/ansibleVerbosityDefault mutation that Load used to
+// perform, so that the watches loader can be embedded as a library (e.g.
+// inside another binary that also loads a separate set of watches) without
+// one caller's settings leaking into another's.
+type Options struct {
+	// MaxWorkers is the default worker count used when a Watch's
+	// WORKER_<KIND>_<GROUP> environment variable is unset or invalid.
+	// Defaults to defaultMaxWorkers when <= 0.
+	MaxWorkers int
+	// AnsibleVerbosity is the default verbosity used when a Watch's
+	// ANSIBLE_VERBOSITY_<KIND>_<GROUP> environment variable is unset or
+	// invalid. Defaults to defaultAnsibleVerbosity when <= 0.
+	AnsibleVerbosity int
+	// AnsibleRolesPath is used to resolve non-absolute role references; see
+	// resolveRolePath. Corresponds to the --ansible-roles-path CLI flag.
+	AnsibleRolesPath string
+	// Env looks up an environment variable, returning ok=false if it is
+	// unset. Used for per-GVK worker/verbosity overrides as well as the
+	// ANSIBLE_ROLES_PATH/ANSIBLE_COLLECTIONS_PATH fallbacks consulted while
+	// resolving role references. Defaults to os.LookupEnv.
+	Env func(string) (string, bool)
+	// Logger receives load/validation errors. Defaults to the package
+	// logger.
+	Logger logr.Logger
+}
+
+// Load - loads a slice of Watches from the watches file from the CLI.
+// ansibleRolesPath is the value of the --ansible-roles-path flag (may be
+// empty, in which case the ANSIBLE_ROLES_PATH environment variable is used
+// instead) and is used to resolve non-absolute role references.
+//
+// Load is a thin backward-compatible wrapper around LoadWithOptions; new
+// code should call LoadWithOptions directly.
+func Load(path string, maxWorkers, ansibleVerbosity int, ansibleRolesPath string) ([]Watch, error) {
+	return LoadWithOptions(path, Options{
+		MaxWorkers:       maxWorkers,
+		AnsibleVerbosity: ansibleVerbosity,
+		AnsibleRolesPath: ansibleRolesPath,
+	})
+}
+
+// LoadWithOptions loads a slice of Watches from the watches file at path,
+// using opts to resolve per-GVK worker counts, ansible verbosity, and role
+// references instead of reading package-level defaults or os.Getenv
+// directly.
+func LoadWithOptions(path string, opts Options) ([]Watch, error) {
+	if opts.MaxWorkers <= 0 {
+		opts.MaxWorkers = defaultMaxWorkers
+	}
+	if opts.AnsibleVerbosity <= 0 {
+		opts.AnsibleVerbosity = defaultAnsibleVerbosity
+	}
+	if opts.Env == nil {
+		opts.Env = os.LookupEnv
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = log
+	}
+
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Error(err, "Failed to get config file")
+		logger.Error(err, "Failed to get config file")
 		return nil, err
 	}
 
 	watches := []Watch{}
 	err = yaml.Unmarshal(b, &watches)
 	if err != nil {
-		log.Error(err, "Failed to unmarshal config")
+		logger.Error(err, "Failed to unmarshal config")
 		return nil, err
 	}
 
 	watchesMap := make(map[schema.GroupVersionKind]bool)
-	for _, watch := range watches {
+	for i := range watches {
+		watch := &watches[i]
 		// prevent dupes
 		if _, ok := watchesMap[watch.GroupVersionKind]; ok {
 			return nil, fmt.Errorf("duplicate GVK: %v", watch.GroupVersionKind.String())
 		}
 		watchesMap[watch.GroupVersionKind] = true
 
-		err = watch.Validate()
+		watch.MaxWorkers = getMaxWorkers(watch.GroupVersionKind, opts.MaxWorkers, opts.Env)
+		watch.AnsibleVerbosity = getAnsibleVerbosity(watch.GroupVersionKind, opts.AnsibleVerbosity, opts.Env)
+
+		err = watch.Validate(opts.AnsibleRolesPath, opts.Env)
 		if err != nil {
-			log.Error(err, fmt.Sprintf("Watch with GVK %v failed validation", watch.GroupVersionKind.String()))
+			logger.Error(err, fmt.Sprintf("Watch with GVK %v failed validation", watch.GroupVersionKind.String()))
 			return nil, err
 		}
 	}
@@ -228,6 +583,48 @@ func Load(path string, maxWorkers, ansibleVerbosity int) ([]Watch, error) {
 	return watches, nil
 }
 
+// Registry owns a set of resolved Watches keyed by GroupVersionKind, so
+// that multiple independent sets can coexist in one process - for example,
+// a hybrid helm+ansible operator embedding this package as a library
+// alongside its own separately-loaded watches.
+type Registry struct {
+	watches map[schema.GroupVersionKind]Watch
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{watches: map[schema.GroupVersionKind]Watch{}}
+}
+
+// Load reads the watches file at path with opts and adds the resulting
+// Watches to r, keyed by GroupVersionKind. A Watch already registered under
+// the same GroupVersionKind is replaced.
+func (r *Registry) Load(path string, opts Options) error {
+	watches, err := LoadWithOptions(path, opts)
+	if err != nil {
+		return err
+	}
+	for _, w := range watches {
+		r.watches[w.GroupVersionKind] = w
+	}
+	return nil
+}
+
+// Get returns the Watch registered for gvk, if any.
+func (r *Registry) Get(gvk schema.GroupVersionKind) (Watch, bool) {
+	w, ok := r.watches[gvk]
+	return w, ok
+}
+
+// Watches returns all Watches currently held by r, in no particular order.
+func (r *Registry) Watches() []Watch {
+	out := make([]Watch, 0, len(r.watches))
+	for _, w := range r.watches {
+		out = append(out, w)
+	}
+	return out
+}
+
 // verify that a given GroupVersionKind has a Version and Kind
 // A GVK without a group is valid. Certain scenarios may cause a GVK
 // without a group to fail in other ways later in the initialization
@@ -242,27 +639,129 @@ func verifyGVK(gvk schema.GroupVersionKind) error {
 	return nil
 }
 
-// verify that a valid path is specified for a given role or playbook
-func verifyAnsiblePath(playbook string, role string) error {
+// verify that a valid path is specified for a given role or playbook.
+// role is resolved via resolveRolePath first, so a bare role name or a
+// fully qualified collection name (namespace.collection.role) is
+// accepted in addition to an absolute path.
+func verifyAnsiblePath(playbook string, role string, rolesPath string, env func(string) (string, bool)) (string, error) {
 	switch {
 	case playbook != "":
 		if !filepath.IsAbs(playbook) {
-			return fmt.Errorf("playbook path must be absolute")
+			return "", fmt.Errorf("playbook path must be absolute")
 		}
 		if _, err := os.Stat(playbook); err != nil {
-			return fmt.Errorf("playbook: %v was not found", playbook)
+			return "", fmt.Errorf("playbook: %v was not found", playbook)
 		}
+		return "", nil
 	case role != "":
-		if !filepath.IsAbs(role) {
-			return fmt.Errorf("role path must be absolute")
+		resolved, err := resolveRolePath(role, rolesPath, env)
+		if err != nil {
+			return "", err
+		}
+		return resolved, nil
+	default:
+		return "", fmt.Errorf("must specify Role or Playbook")
+	}
+}
+
+// resolveRolePath resolves a role reference the way stock ansible does:
+//  1. if role is already an absolute path that exists, it is used as-is.
+//  2. otherwise it is tried relative to each directory of rolesPath (falling
+//     back to the ANSIBLE_ROLES_PATH environment variable), then relative to
+//     the current working directory, then relative to /opt/ansible/roles.
+//  3. otherwise, if role looks like a fully qualified collection name of the
+//     form namespace.collection.role_name, it is resolved under each
+//     directory of ANSIBLE_COLLECTIONS_PATH (falling back to
+//     ~/.ansible/collections and /usr/share/ansible/collections) as
+//     ansible_collections/<namespace>/<collection>/roles/<role_name>.
+//
+// The returned path is always absolute. If role cannot be resolved, the
+// error lists every location that was tried.
+func resolveRolePath(role string, rolesPath string, env func(string) (string, bool)) (string, error) {
+	if filepath.IsAbs(role) {
+		if _, err := os.Stat(role); err == nil {
+			return role, nil
+		}
+	}
+
+	var tried []string
+
+	for _, dir := range rolesPathDirs(rolesPath, env) {
+		candidate := filepath.Join(dir, role)
+		if abs, err := filepath.Abs(candidate); err == nil {
+			candidate = abs
+		}
+		tried = append(tried, candidate)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
 		}
-		if _, err := os.Stat(role); err != nil {
-			return fmt.Errorf("role path: %v was not found", role)
+	}
+
+	if ns, collection, roleName, ok := splitFQCNRole(role); ok {
+		for _, dir := range collectionsPathDirs(env) {
+			candidate := filepath.Join(dir, "ansible_collections", ns, collection, "roles", roleName)
+			if abs, err := filepath.Abs(candidate); err == nil {
+				candidate = abs
+			}
+			tried = append(tried, candidate)
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, nil
+			}
 		}
+	}
+
+	return "", fmt.Errorf("role path: %v was not found, tried: %v", role, tried)
+}
+
+// rolesPathDirs returns the ordered list of directories to search for a
+// role, given the --ansible-roles-path flag value (rolesPath, which may be
+// empty). Multiple directories may be given in rolesPath or
+// ANSIBLE_ROLES_PATH, separated by filepath.ListSeparator.
+func rolesPathDirs(rolesPath string, env func(string) (string, bool)) []string {
+	var dirs []string
+	switch {
+	case rolesPath != "":
+		dirs = append(dirs, filepath.SplitList(rolesPath)...)
 	default:
-		return fmt.Errorf("must specify Role or Playbook")
+		if p, ok := env("ANSIBLE_ROLES_PATH"); ok && p != "" {
+			dirs = append(dirs, filepath.SplitList(p)...)
+		}
 	}
-	return nil
+	if cwd, err := os.Getwd(); err == nil {
+		dirs = append(dirs, cwd)
+	}
+	dirs = append(dirs, "/opt/ansible/roles")
+	return dirs
+}
+
+// collectionsPathDirs returns the ordered list of directories to search for
+// an installed collection, honoring ANSIBLE_COLLECTIONS_PATH and falling
+// back to the well-known user and system collection directories.
+func collectionsPathDirs(env func(string) (string, bool)) []string {
+	var dirs []string
+	if p, ok := env("ANSIBLE_COLLECTIONS_PATH"); ok && p != "" {
+		dirs = append(dirs, filepath.SplitList(p)...)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".ansible", "collections"))
+	}
+	dirs = append(dirs, "/usr/share/ansible/collections")
+	return dirs
+}
+
+// splitFQCNRole splits role into its namespace, collection, and role name
+// parts if it is a fully qualified collection name (namespace.collection.role_name).
+func splitFQCNRole(role string) (namespace, collection, roleName string, ok bool) {
+	parts := strings.Split(role, ".")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	for _, p := range parts {
+		if p == "" {
+			return "", "", "", false
+		}
+	}
+	return parts[0], parts[1], parts[2], true
 }
 
 // if the WORKER_* environment variable is set, use that value.
@@ -271,14 +770,14 @@ func verifyAnsiblePath(playbook string, role string) error {
 // number of workers based on their cluster resources. While the
 // author may use the CLI option to specify a suggested
 // configuration for the operator.
-func getMaxWorkers(gvk schema.GroupVersionKind, defValue int) int {
+func getMaxWorkers(gvk schema.GroupVersionKind, defValue int, env func(string) (string, bool)) int {
 	envVar := strings.ToUpper(strings.Replace(
 		fmt.Sprintf("WORKER_%s_%s", gvk.Kind, gvk.Group),
 		".",
 		"_",
 		-1,
 	))
-	maxWorkers := getIntegerEnvWithDefault(envVar, defValue)
+	maxWorkers := getIntegerEnvWithDefault(envVar, defValue, env)
 	if maxWorkers <= 0 {
 		log.Info("Value %v not valid. Using default %v", maxWorkers, defValue)
 		return defValue
@@ -288,14 +787,14 @@ func getMaxWorkers(gvk schema.GroupVersionKind, defValue int) int {
 
 // if the ANSIBLE_VERBOSITY_* environment variable is set, use that value.
 // Otherwise, use defValue.
-func getAnsibleVerbosity(gvk schema.GroupVersionKind, defValue int) int {
+func getAnsibleVerbosity(gvk schema.GroupVersionKind, defValue int, env func(string) (string, bool)) int {
 	envVar := strings.ToUpper(strings.Replace(
 		fmt.Sprintf("ANSIBLE_VERBOSITY_%s_%s", gvk.Kind, gvk.Group),
 		".",
 		"_",
 		-1,
 	))
-	ansibleVerbosity := getIntegerEnvWithDefault(envVar, defValue)
+	ansibleVerbosity := getIntegerEnvWithDefault(envVar, defValue, env)
 	// Use default value when value doesn't make sense
 	if ansibleVerbosity < 0 {
 		log.Info("Value %v not valid. Using default %v", ansibleVerbosity, defValue)
@@ -310,9 +809,9 @@ func getAnsibleVerbosity(gvk schema.GroupVersionKind, defValue int) int {
 
 // getIntegerEnvWithDefault returns value for MaxWorkers/Ansibleverbosity based on if envVar is set
 // sor a defvalue is used.
-func getIntegerEnvWithDefault(envVar string, defValue int) int {
+func getIntegerEnvWithDefault(envVar string, defValue int, env func(string) (string, bool)) int {
 	val := defValue
-	if envVal, ok := os.LookupEnv(envVar); ok {
+	if envVal, ok := env(envVar); ok {
 		if i, err := strconv.Atoi(envVal); err != nil {
 			log.Info("Could not parse environment variable as an integer; using default value",
 				"envVar", envVar, "default", defValue)
@@ -325,3 +824,122 @@ func getIntegerEnvWithDefault(envVar string, defValue int) int {
 	}
 	return val
 }
+
+// RenderVars returns a copy of vars with every occurrence of ${CR_NAMESPACE}
+// and ${CR_NAME} in string values (including nested maps and slices)
+// replaced with crNamespace and crName, so operators can forward CR
+// identity into vars without writing a playbook task.
+func RenderVars(vars map[string]interface{}, crNamespace, crName string) map[string]interface{} {
+	if vars == nil {
+		return nil
+	}
+	replacer := strings.NewReplacer("${CR_NAMESPACE}", crNamespace, "${CR_NAME}", crName)
+	return renderVarsValue(vars, replacer).(map[string]interface{})
+}
+
+func renderVarsValue(value interface{}, replacer *strings.Replacer) interface{} {
+	switch v := value.(type) {
+	case string:
+		return replacer.Replace(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[k] = renderVarsValue(val, replacer)
+		}
+		return out
+	// yaml.v2 decodes nested mappings under a map[string]interface{} field
+	// (e.g. Watch.Vars) as map[interface{}]interface{}, so this case is hit
+	// even when the caller never ran the value through stringifyYAMLKeys.
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[fmt.Sprintf("%v", k)] = renderVarsValue(val, replacer)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = renderVarsValue(val, replacer)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// ResolveVarsFrom resolves each VarSource in sources, in order, and merges
+// the results into a single map, with later sources overriding earlier
+// ones on key conflicts. namespace is used for any secretRef/configMapRef
+// that does not specify its own namespace, and is typically the CR's
+// namespace. c is used to fetch in-cluster Secret/ConfigMap references; it
+// may be nil if sources only contains file references.
+func ResolveVarsFrom(ctx context.Context, c client.Client, namespace string, sources []VarSource) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+	for i, source := range sources {
+		resolved, err := source.resolve(ctx, c, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("varsFrom[%d]: %w", i, err)
+		}
+		for k, v := range resolved {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// resolve reads the YAML mapping referenced by v and returns it as vars to
+// merge.
+func (v VarSource) resolve(ctx context.Context, c client.Client, namespace string) (map[string]interface{}, error) {
+	switch {
+	case v.SecretRef != nil:
+		ns := v.SecretRef.Namespace
+		if ns == "" {
+			ns = namespace
+		}
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: ns, Name: v.SecretRef.Name}, secret); err != nil {
+			return nil, fmt.Errorf("failed to get secret %s/%s: %w", ns, v.SecretRef.Name, err)
+		}
+		data, ok := secret.Data[v.SecretRef.Key]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found in secret %s/%s", v.SecretRef.Key, ns, v.SecretRef.Name)
+		}
+		return parseVarsYAML(data)
+	case v.ConfigMapRef != nil:
+		ns := v.ConfigMapRef.Namespace
+		if ns == "" {
+			ns = namespace
+		}
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: ns, Name: v.ConfigMapRef.Name}, configMap); err != nil {
+			return nil, fmt.Errorf("failed to get configmap %s/%s: %w", ns, v.ConfigMapRef.Name, err)
+		}
+		if data, ok := configMap.Data[v.ConfigMapRef.Key]; ok {
+			return parseVarsYAML([]byte(data))
+		}
+		if data, ok := configMap.BinaryData[v.ConfigMapRef.Key]; ok {
+			return parseVarsYAML(data)
+		}
+		return nil, fmt.Errorf("key %q not found in configmap %s/%s", v.ConfigMapRef.Key, ns, v.ConfigMapRef.Name)
+	case v.File != "":
+		b, err := ioutil.ReadFile(v.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vars file %q: %w", v.File, err)
+		}
+		return parseVarsYAML(b)
+	default:
+		return nil, fmt.Errorf("varsFrom entry must specify secretRef, configMapRef, or file")
+	}
+}
+
+// parseVarsYAML unmarshals b, expected to be a YAML mapping, into vars.
+func parseVarsYAML(b []byte) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &vars); err != nil {
+		return nil, fmt.Errorf("failed to parse vars: %w", err)
+	}
+	// yaml.v2 decodes nested mappings as map[interface{}]interface{}, which
+	// can't be json-marshalled for ansible-runner; normalize to
+	// map[string]interface{} throughout.
+	return stringifyYAMLKeys(vars).(map[string]interface{}), nil
+}
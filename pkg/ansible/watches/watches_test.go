@@ -0,0 +1,684 @@
+// Copyright 2018 The Operator-SDK Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watches
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// envFromMap returns an env lookup func backed by m, for tests that need to
+// inject ANSIBLE_ROLES_PATH/ANSIBLE_COLLECTIONS_PATH without touching the
+// real process environment.
+func envFromMap(m map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := m[key]
+		return v, ok
+	}
+}
+
+func TestDecodeSelector(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		selector, err := decodeSelector(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(selector.MatchLabels) != 0 || len(selector.MatchExpressions) != 0 {
+			t.Fatalf("expected empty selector, got %+v", selector)
+		}
+	})
+
+	t.Run("matchLabels and matchExpressions", func(t *testing.T) {
+		var raw interface{}
+		in := []byte(`
+matchLabels:
+  app: foo
+matchExpressions:
+- key: tier
+  operator: In
+  values:
+  - backend
+  - frontend
+`)
+		if err := yaml.Unmarshal(in, &raw); err != nil {
+			t.Fatalf("failed to unmarshal fixture: %v", err)
+		}
+
+		selector, err := decodeSelector(raw)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if selector.MatchLabels["app"] != "foo" {
+			t.Fatalf("expected matchLabels.app=foo, got %+v", selector.MatchLabels)
+		}
+		if len(selector.MatchExpressions) != 1 {
+			t.Fatalf("expected 1 matchExpression, got %d", len(selector.MatchExpressions))
+		}
+		expr := selector.MatchExpressions[0]
+		if expr.Key != "tier" || expr.Operator != metav1.LabelSelectorOpIn {
+			t.Fatalf("unexpected matchExpression: %+v", expr)
+		}
+		if len(expr.Values) != 2 || expr.Values[0] != "backend" || expr.Values[1] != "frontend" {
+			t.Fatalf("unexpected matchExpression values: %+v", expr.Values)
+		}
+	})
+}
+
+func TestNewBackwardCompatible(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+
+	w := New(gvk, "/some/role", "", nil, nil)
+	if len(w.Selector.MatchLabels) != 0 || len(w.Selector.MatchExpressions) != 0 {
+		t.Fatalf("expected New to default to an empty selector, got %+v", w.Selector)
+	}
+
+	withSelector := NewWithSelector(gvk, "/some/role", "", nil, nil, metav1.LabelSelector{
+		MatchLabels: map[string]string{"app": "foo"},
+	})
+	if withSelector.Selector.MatchLabels["app"] != "foo" {
+		t.Fatalf("expected NewWithSelector to set the selector, got %+v", withSelector.Selector)
+	}
+}
+
+func TestVarSourceValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		source  VarSource
+		wantErr bool
+	}{
+		{
+			name:   "valid secretRef",
+			source: VarSource{SecretRef: &SecretVarSource{Name: "s", Key: "k"}},
+		},
+		{
+			name:   "valid configMapRef",
+			source: VarSource{ConfigMapRef: &ConfigMapVarSource{Name: "c", Key: "k"}},
+		},
+		{
+			name:   "valid file",
+			source: VarSource{File: "/tmp/vars.yml"},
+		},
+		{
+			name:    "no source set",
+			source:  VarSource{},
+			wantErr: true,
+		},
+		{
+			name: "multiple sources set",
+			source: VarSource{
+				SecretRef: &SecretVarSource{Name: "s", Key: "k"},
+				File:      "/tmp/vars.yml",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "secretRef missing key",
+			source:  VarSource{SecretRef: &SecretVarSource{Name: "s"}},
+			wantErr: true,
+		},
+		{
+			name:    "configMapRef missing name",
+			source:  VarSource{ConfigMapRef: &ConfigMapVarSource{Key: "k"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.source.Validate()
+			if tc.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseVarsYAMLAndRenderVarsNested(t *testing.T) {
+	vars, err := parseVarsYAML([]byte(`
+db:
+  host: ${CR_NAME}-db
+  namespace: ${CR_NAMESPACE}
+tags:
+- ${CR_NAME}
+- static
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db, ok := vars["db"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected vars[\"db\"] to be map[string]interface{}, got %T", vars["db"])
+	}
+	if _, ok := db["host"].(string); !ok {
+		t.Fatalf("expected db.host to be a string, got %T", db["host"])
+	}
+
+	rendered := RenderVars(vars, "my-ns", "my-cr")
+
+	renderedDB, ok := rendered["db"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected rendered[\"db\"] to be map[string]interface{}, got %T", rendered["db"])
+	}
+	if renderedDB["host"] != "my-cr-db" {
+		t.Fatalf("expected templated host, got %v", renderedDB["host"])
+	}
+	if renderedDB["namespace"] != "my-ns" {
+		t.Fatalf("expected templated namespace, got %v", renderedDB["namespace"])
+	}
+
+	tags, ok := rendered["tags"].([]interface{})
+	if !ok || tags[0] != "my-cr" || tags[1] != "static" {
+		t.Fatalf("unexpected rendered tags: %+v", rendered["tags"])
+	}
+}
+
+func TestResolveVarsFromOrdering(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.yml")
+	second := filepath.Join(dir, "second.yml")
+	if err := ioutil.WriteFile(first, []byte("a: 1\nb: 1\n"), 0o600); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+	if err := ioutil.WriteFile(second, []byte("b: 2\nc: 2\n"), 0o600); err != nil {
+		t.Fatalf("failed to write fixture: %v", err)
+	}
+
+	merged, err := ResolveVarsFrom(context.Background(), nil, "default", []VarSource{
+		{File: first},
+		{File: second},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if merged["a"] != 1 || merged["b"] != 2 || merged["c"] != 2 {
+		t.Fatalf("expected later source to override earlier one, got %+v", merged)
+	}
+}
+
+func TestResolveVarsFromSecretAndConfigMap(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to build scheme: %v", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "default"},
+		Data:       map[string][]byte{"vars.yml": []byte("a: 1\n")},
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-configmap", Namespace: "default"},
+		Data:       map[string]string{"vars.yml": "a: 2\nb: 2\n"},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, configMap).Build()
+
+	merged, err := ResolveVarsFrom(context.Background(), c, "default", []VarSource{
+		{SecretRef: &SecretVarSource{Name: "my-secret", Key: "vars.yml"}},
+		{ConfigMapRef: &ConfigMapVarSource{Name: "my-configmap", Key: "vars.yml"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if merged["a"] != 2 || merged["b"] != 2 {
+		t.Fatalf("expected configMapRef (later source) to override secretRef, got %+v", merged)
+	}
+}
+
+func TestSplitFQCNRole(t *testing.T) {
+	cases := []struct {
+		name           string
+		role           string
+		wantNS         string
+		wantCollection string
+		wantRoleName   string
+		wantOK         bool
+	}{
+		{name: "valid FQCN", role: "my_ns.my_collection.my_role", wantNS: "my_ns", wantCollection: "my_collection", wantRoleName: "my_role", wantOK: true},
+		{name: "bare role name", role: "my_role", wantOK: false},
+		{name: "too many parts", role: "a.b.c.d", wantOK: false},
+		{name: "empty part", role: "a..c", wantOK: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns, collection, roleName, ok := splitFQCNRole(tc.role)
+			if ok != tc.wantOK {
+				t.Fatalf("expected ok=%v, got %v", tc.wantOK, ok)
+			}
+			if !tc.wantOK {
+				return
+			}
+			if ns != tc.wantNS || collection != tc.wantCollection || roleName != tc.wantRoleName {
+				t.Fatalf("expected (%s, %s, %s), got (%s, %s, %s)", tc.wantNS, tc.wantCollection, tc.wantRoleName, ns, collection, roleName)
+			}
+		})
+	}
+}
+
+func TestResolveRolePath(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("absolute path that exists", func(t *testing.T) {
+		abs := filepath.Join(dir, "abs-role")
+		if err := os.MkdirAll(abs, 0o755); err != nil {
+			t.Fatalf("failed to create fixture dir: %v", err)
+		}
+		got, err := resolveRolePath(abs, "", envFromMap(nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != abs {
+			t.Fatalf("expected %s, got %s", abs, got)
+		}
+	})
+
+	t.Run("resolved via rolesPath", func(t *testing.T) {
+		rolesDir := filepath.Join(dir, "roles")
+		roleDir := filepath.Join(rolesDir, "myrole")
+		if err := os.MkdirAll(roleDir, 0o755); err != nil {
+			t.Fatalf("failed to create fixture dir: %v", err)
+		}
+		got, err := resolveRolePath("myrole", rolesDir, envFromMap(nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != roleDir {
+			t.Fatalf("expected %s, got %s", roleDir, got)
+		}
+	})
+
+	t.Run("resolved via ANSIBLE_ROLES_PATH env fallback when rolesPath is empty", func(t *testing.T) {
+		rolesDir := filepath.Join(dir, "env-roles")
+		roleDir := filepath.Join(rolesDir, "envrole")
+		if err := os.MkdirAll(roleDir, 0o755); err != nil {
+			t.Fatalf("failed to create fixture dir: %v", err)
+		}
+		env := envFromMap(map[string]string{"ANSIBLE_ROLES_PATH": rolesDir})
+		got, err := resolveRolePath("envrole", "", env)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != roleDir {
+			t.Fatalf("expected %s, got %s", roleDir, got)
+		}
+
+		// rolesPath, when set, takes priority over the env var - the env var
+		// should not even be consulted.
+		otherDir := filepath.Join(dir, "other-roles")
+		if err := os.MkdirAll(filepath.Join(otherDir, "envrole"), 0o755); err != nil {
+			t.Fatalf("failed to create fixture dir: %v", err)
+		}
+		got, err = resolveRolePath("envrole", otherDir, env)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != filepath.Join(otherDir, "envrole") {
+			t.Fatalf("expected rolesPath to take priority, got %s", got)
+		}
+	})
+
+	t.Run("resolved as FQCN under ANSIBLE_COLLECTIONS_PATH", func(t *testing.T) {
+		collectionsDir := filepath.Join(dir, "collections")
+		roleDir := filepath.Join(collectionsDir, "ansible_collections", "my_ns", "my_collection", "roles", "my_role")
+		if err := os.MkdirAll(roleDir, 0o755); err != nil {
+			t.Fatalf("failed to create fixture dir: %v", err)
+		}
+		env := envFromMap(map[string]string{"ANSIBLE_COLLECTIONS_PATH": collectionsDir})
+		got, err := resolveRolePath("my_ns.my_collection.my_role", "", env)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != roleDir {
+			t.Fatalf("expected %s, got %s", roleDir, got)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := resolveRolePath("does-not-exist", dir, envFromMap(nil))
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestUnmarshalYAMLDefaults(t *testing.T) {
+	var w Watch
+	in := []byte(`
+group: apps
+version: v1
+kind: Deployment
+role: /some/role
+`)
+	if err := yaml.Unmarshal(in, &w); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.EventFilters != (EventFilters{Create: true, Update: true, Delete: true, Generic: true}) {
+		t.Fatalf("expected default EventFilters to enable every event, got %+v", w.EventFilters)
+	}
+	if w.Snakecase {
+		t.Fatalf("expected Snakecase to default to false, got %v", w.Snakecase)
+	}
+	if w.RetryBackoff.Initial != time.Second {
+		t.Fatalf("expected RetryBackoff.Initial to default to 1s, got %v", w.RetryBackoff.Initial)
+	}
+	if w.RetryBackoff.Max != 300*time.Second {
+		t.Fatalf("expected RetryBackoff.Max to default to 300s, got %v", w.RetryBackoff.Max)
+	}
+	if w.RetryBackoff.Factor != 2.0 {
+		t.Fatalf("expected RetryBackoff.Factor to default to 2.0, got %v", w.RetryBackoff.Factor)
+	}
+}
+
+func TestUnmarshalYAMLRetryBackoffOverride(t *testing.T) {
+	var w Watch
+	in := []byte(`
+group: apps
+version: v1
+kind: Deployment
+role: /some/role
+retryBackoff:
+  initial: 5s
+  max: 1m
+  factor: 1.5
+`)
+	if err := yaml.Unmarshal(in, &w); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if w.RetryBackoff.Initial != 5*time.Second {
+		t.Fatalf("expected RetryBackoff.Initial to be 5s, got %v", w.RetryBackoff.Initial)
+	}
+	if w.RetryBackoff.Max != time.Minute {
+		t.Fatalf("expected RetryBackoff.Max to be 1m, got %v", w.RetryBackoff.Max)
+	}
+	if w.RetryBackoff.Factor != 1.5 {
+		t.Fatalf("expected RetryBackoff.Factor to be 1.5, got %v", w.RetryBackoff.Factor)
+	}
+}
+
+func TestUnmarshalYAMLRetryBackoffInvalidDuration(t *testing.T) {
+	var w Watch
+	in := []byte(`
+group: apps
+version: v1
+kind: Deployment
+role: /some/role
+retryBackoff:
+  initial: not-a-duration
+`)
+	if err := yaml.Unmarshal(in, &w); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestUnmarshalYAMLInvalidHookName(t *testing.T) {
+	var w Watch
+	in := []byte(`
+group: apps
+version: v1
+kind: Deployment
+role: /some/role
+hooks:
+  notARealHook:
+    role: /some/hook-role
+`)
+	if err := yaml.Unmarshal(in, &w); err == nil {
+		t.Fatal("expected error for invalid hook name, got nil")
+	}
+}
+
+func TestUnmarshalYAMLValidHookNames(t *testing.T) {
+	var w Watch
+	in := []byte(`
+group: apps
+version: v1
+kind: Deployment
+role: /some/role
+hooks:
+  preReconcile:
+    role: /some/hook-role
+  postReconcile:
+    playbook: /some/hook.yml
+  preDelete:
+    role: /some/other-hook-role
+`)
+	if err := yaml.Unmarshal(in, &w); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.Hooks) != 3 {
+		t.Fatalf("expected 3 hooks, got %d: %+v", len(w.Hooks), w.Hooks)
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	dir := t.TempDir()
+	roleDir := filepath.Join(dir, "hook-role")
+	if err := os.MkdirAll(roleDir, 0o755); err != nil {
+		t.Fatalf("failed to create fixture dir: %v", err)
+	}
+
+	t.Run("resolves hook role path", func(t *testing.T) {
+		w := Watch{
+			GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Role:             roleDir,
+			Hooks:            map[string]Hook{HookPreReconcile: {Role: "hook-role"}},
+		}
+		if err := w.Validate(dir, os.LookupEnv); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if w.Hooks[HookPreReconcile].Role != roleDir {
+			t.Fatalf("expected hook role to be resolved to %s, got %s", roleDir, w.Hooks[HookPreReconcile].Role)
+		}
+	})
+
+	t.Run("rejects hook with unresolvable role", func(t *testing.T) {
+		w := Watch{
+			GroupVersionKind: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Role:             roleDir,
+			Hooks:            map[string]Hook{HookPostReconcile: {Role: "does-not-exist"}},
+		}
+		if err := w.Validate(dir, os.LookupEnv); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	})
+}
+
+func TestNewDefaultsEventFiltersAndRetryBackoff(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+
+	w := New(gvk, "/some/role", "", nil, nil)
+	if w.EventFilters != (EventFilters{Create: true, Update: true, Delete: true, Generic: true}) {
+		t.Fatalf("expected New to default EventFilters to enable every event, got %+v", w.EventFilters)
+	}
+	if w.RetryBackoff.Initial != time.Second || w.RetryBackoff.Max != 300*time.Second || w.RetryBackoff.Factor != 2.0 {
+		t.Fatalf("expected New to default RetryBackoff, got %+v", w.RetryBackoff)
+	}
+
+	withSelector := NewWithSelector(gvk, "/some/role", "", nil, nil, metav1.LabelSelector{})
+	if withSelector.EventFilters != (EventFilters{Create: true, Update: true, Delete: true, Generic: true}) {
+		t.Fatalf("expected NewWithSelector to default EventFilters to enable every event, got %+v", withSelector.EventFilters)
+	}
+	if withSelector.RetryBackoff.Initial != time.Second || withSelector.RetryBackoff.Max != 300*time.Second || withSelector.RetryBackoff.Factor != 2.0 {
+		t.Fatalf("expected NewWithSelector to default RetryBackoff, got %+v", withSelector.RetryBackoff)
+	}
+}
+
+func writeWatchesFile(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, "watches.yml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write watches file: %v", err)
+	}
+	return path
+}
+
+func TestLoadWithOptionsDefaultsAndOverrides(t *testing.T) {
+	dir := t.TempDir()
+	roleDir := filepath.Join(dir, "myrole")
+	if err := os.MkdirAll(roleDir, 0o755); err != nil {
+		t.Fatalf("failed to create fixture dir: %v", err)
+	}
+
+	path := writeWatchesFile(t, dir, `
+- group: apps
+  version: v1
+  kind: Deployment
+  role: myrole
+`)
+
+	t.Run("package defaults apply when Options leaves MaxWorkers and AnsibleVerbosity unset", func(t *testing.T) {
+		watches, err := LoadWithOptions(path, Options{AnsibleRolesPath: dir})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(watches) != 1 {
+			t.Fatalf("expected 1 watch, got %d", len(watches))
+		}
+		if watches[0].MaxWorkers != defaultMaxWorkers {
+			t.Fatalf("expected MaxWorkers to default to %d, got %d", defaultMaxWorkers, watches[0].MaxWorkers)
+		}
+		if watches[0].AnsibleVerbosity != defaultAnsibleVerbosity {
+			t.Fatalf("expected AnsibleVerbosity to default to %d, got %d", defaultAnsibleVerbosity, watches[0].AnsibleVerbosity)
+		}
+		if watches[0].Role != roleDir {
+			t.Fatalf("expected resolved role %s, got %s", roleDir, watches[0].Role)
+		}
+	})
+
+	t.Run("Options.Env overrides per-GVK worker count and verbosity", func(t *testing.T) {
+		env := envFromMap(map[string]string{
+			"WORKER_DEPLOYMENT_APPS":            "5",
+			"ANSIBLE_VERBOSITY_DEPLOYMENT_APPS": "4",
+		})
+		watches, err := LoadWithOptions(path, Options{AnsibleRolesPath: dir, Env: env})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if watches[0].MaxWorkers != 5 {
+			t.Fatalf("expected MaxWorkers 5, got %d", watches[0].MaxWorkers)
+		}
+		if watches[0].AnsibleVerbosity != 4 {
+			t.Fatalf("expected AnsibleVerbosity 4, got %d", watches[0].AnsibleVerbosity)
+		}
+	})
+
+	t.Run("two Options using distinct Env do not leak into each other", func(t *testing.T) {
+		envA := envFromMap(map[string]string{"WORKER_DEPLOYMENT_APPS": "2"})
+		envB := envFromMap(map[string]string{"WORKER_DEPLOYMENT_APPS": "9"})
+
+		watchesA, err := LoadWithOptions(path, Options{AnsibleRolesPath: dir, Env: envA})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		watchesB, err := LoadWithOptions(path, Options{AnsibleRolesPath: dir, Env: envB})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if watchesA[0].MaxWorkers != 2 || watchesB[0].MaxWorkers != 9 {
+			t.Fatalf("expected independent MaxWorkers (2, 9), got (%d, %d)", watchesA[0].MaxWorkers, watchesB[0].MaxWorkers)
+		}
+	})
+}
+
+func TestLoadWithOptionsDuplicateGVK(t *testing.T) {
+	dir := t.TempDir()
+	roleDir := filepath.Join(dir, "myrole")
+	if err := os.MkdirAll(roleDir, 0o755); err != nil {
+		t.Fatalf("failed to create fixture dir: %v", err)
+	}
+	path := writeWatchesFile(t, dir, `
+- group: apps
+  version: v1
+  kind: Deployment
+  role: myrole
+- group: apps
+  version: v1
+  kind: Deployment
+  role: myrole
+`)
+
+	if _, err := LoadWithOptions(path, Options{AnsibleRolesPath: dir}); err == nil {
+		t.Fatal("expected error for duplicate GVK, got nil")
+	}
+}
+
+func TestLoadBackwardCompatible(t *testing.T) {
+	dir := t.TempDir()
+	roleDir := filepath.Join(dir, "myrole")
+	if err := os.MkdirAll(roleDir, 0o755); err != nil {
+		t.Fatalf("failed to create fixture dir: %v", err)
+	}
+	path := writeWatchesFile(t, dir, `
+- group: apps
+  version: v1
+  kind: Deployment
+  role: myrole
+`)
+
+	watches, err := Load(path, 3, 1, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(watches) != 1 || watches[0].MaxWorkers != 3 || watches[0].AnsibleVerbosity != 1 {
+		t.Fatalf("unexpected watches: %+v", watches)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	roleDir := filepath.Join(dir, "myrole")
+	if err := os.MkdirAll(roleDir, 0o755); err != nil {
+		t.Fatalf("failed to create fixture dir: %v", err)
+	}
+	path := writeWatchesFile(t, dir, `
+- group: apps
+  version: v1
+  kind: Deployment
+  role: myrole
+`)
+
+	r := NewRegistry()
+	if err := r.Load(path, Options{AnsibleRolesPath: dir}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	w, ok := r.Get(gvk)
+	if !ok {
+		t.Fatalf("expected registry to contain %v", gvk)
+	}
+	if w.Role != roleDir {
+		t.Fatalf("expected resolved role %s, got %s", roleDir, w.Role)
+	}
+	if len(r.Watches()) != 1 {
+		t.Fatalf("expected 1 watch, got %d", len(r.Watches()))
+	}
+
+	if _, ok := r.Get(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"}); ok {
+		t.Fatal("expected no entry for an unregistered GVK")
+	}
+}